@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 (http://www.softwareishard.com/blog/har-12-spec/) structures. Only
+// the fields this proxy can actually populate are included; everything else
+// defaults to its zero value per the spec's "optional" fields.
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string       `json:"startedDateTime"`
+	Time            float64      `json:"time"`
+	Request         harRequest   `json:"request"`
+	Response        harResponse  `json:"response"`
+	Cache           harCache     `json:"cache"`
+	Timings         harTimings   `json:"timings"`
+	Comment         string       `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string        `json:"method"`
+	URL         string        `json:"url"`
+	HTTPVersion string        `json:"httpVersion"`
+	Headers     []harNV       `json:"headers"`
+	QueryString []harNV       `json:"queryString"`
+	Cookies     []harNV       `json:"cookies"`
+	PostData    *harPostData  `json:"postData,omitempty"`
+	HeadersSize int64         `json:"headersSize"`
+	BodySize    int64         `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harResponse struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Headers     []harNV     `json:"headers"`
+	Cookies     []harNV     `json:"cookies"`
+	Content     harContent  `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int64       `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harCache struct{}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+type harNV struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// harCollector accumulates HAR entries in memory and flushes them to
+// harPath on Close (or on an optional rotation interval).
+type harCollector struct {
+	path string
+
+	mu      sync.Mutex
+	entries []harEntry
+
+	rotateTicker *time.Ticker
+	stop         chan struct{}
+}
+
+// newHARCollector starts accumulating entries for later export to path. If
+// rotateInterval is non-zero, the log is also flushed to disk on that
+// interval (in addition to on Close).
+func newHARCollector(path string, rotateInterval time.Duration) *harCollector {
+	c := &harCollector{path: path, stop: make(chan struct{})}
+	if rotateInterval > 0 {
+		c.rotateTicker = time.NewTicker(rotateInterval)
+		go func() {
+			for {
+				select {
+				case <-c.rotateTicker.C:
+					if err := c.flush(); err != nil {
+						log.Printf("HAR: periodic flush to %v failed: %v", c.path, err)
+					}
+				case <-c.stop:
+					return
+				}
+			}
+		}()
+	}
+	return c
+}
+
+func (c *harCollector) add(e harEntry) {
+	c.mu.Lock()
+	c.entries = append(c.entries, e)
+	c.mu.Unlock()
+}
+
+func (c *harCollector) flush() error {
+	c.mu.Lock()
+	entries := make([]harEntry, len(c.entries))
+	copy(entries, c.entries)
+	c.mu.Unlock()
+
+	doc := harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "go-forward-http", Version: "1.0"},
+		Entries: entries,
+	}
+	out, err := json.MarshalIndent(struct {
+		Log harLog `json:"log"`
+	}{Log: doc}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, out, 0644)
+}
+
+// Close stops the rotation ticker (if any) and flushes a final time.
+func (c *harCollector) Close() error {
+	if c.rotateTicker != nil {
+		c.rotateTicker.Stop()
+		close(c.stop)
+	}
+	return c.flush()
+}
+
+func headersToNV(h http.Header) []harNV {
+	nv := make([]harNV, 0, len(h))
+	for k, vals := range h {
+		for _, v := range vals {
+			nv = append(nv, harNV{Name: k, Value: v})
+		}
+	}
+	return nv
+}
+
+func cookiesToNV(cookies []*http.Cookie) []harNV {
+	nv := make([]harNV, 0, len(cookies))
+	for _, c := range cookies {
+		nv = append(nv, harNV{Name: c.Name, Value: c.Value})
+	}
+	return nv
+}
+
+func queryToNV(r *http.Request) []harNV {
+	nv := make([]harNV, 0)
+	for k, vals := range r.URL.Query() {
+		for _, v := range vals {
+			nv = append(nv, harNV{Name: k, Value: v})
+		}
+	}
+	return nv
+}
+
+// bodyContent returns body as text if it's valid UTF-8 (with an empty
+// encoding), or base64-encoded otherwise (with encoding "base64").
+func bodyContent(body []byte) (text, encoding string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+// recordHTTPEntry builds and stores a HAR entry for a completed HTTP
+// round trip, given the timing breakdown captured via httptrace.
+func (c *harCollector) recordHTTPEntry(r *http.Request, res *http.Response, started time.Time, reqBody, resBody []byte, timing harTimings) {
+	total := time.Since(started).Seconds() * 1000
+
+	reqText, _ := bodyContent(reqBody)
+	var postData *harPostData
+	if len(reqBody) > 0 {
+		postData = &harPostData{MimeType: r.Header.Get("Content-Type"), Text: reqText}
+	}
+	resText, resEncoding := bodyContent(resBody)
+
+	entry := harEntry{
+		StartedDateTime: started.Format(time.RFC3339Nano),
+		Time:            total,
+		Request: harRequest{
+			Method:      r.Method,
+			URL:         r.URL.String(),
+			HTTPVersion: r.Proto,
+			Headers:     headersToNV(r.Header),
+			QueryString: queryToNV(r),
+			Cookies:     cookiesToNV(r.Cookies()),
+			PostData:    postData,
+			HeadersSize: -1,
+			BodySize:    int64(len(reqBody)),
+		},
+		Response: harResponse{
+			Status:      res.StatusCode,
+			StatusText:  http.StatusText(res.StatusCode),
+			HTTPVersion: res.Proto,
+			Headers:     headersToNV(res.Header),
+			Cookies:     cookiesToNV(res.Cookies()),
+			Content: harContent{
+				Size:     int64(len(resBody)),
+				MimeType: res.Header.Get("Content-Type"),
+				Text:     resText,
+				Encoding: resEncoding,
+			},
+			HeadersSize: -1,
+			BodySize:    int64(len(resBody)),
+		},
+		Timings: timing,
+	}
+	c.add(entry)
+}
+
+// recordTunnelEntry stores a metadata-only entry for an opaque (non-MITM)
+// CONNECT tunnel, whose contents the proxy never decrypts.
+func (c *harCollector) recordTunnelEntry(r *http.Request, started time.Time) {
+	entry := harEntry{
+		StartedDateTime: started.Format(time.RFC3339Nano),
+		Request: harRequest{
+			Method:      http.MethodConnect,
+			URL:         "https://" + r.Host,
+			HTTPVersion: r.Proto,
+			Headers:     headersToNV(r.Header),
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Response: harResponse{
+			Status:      http.StatusOK,
+			StatusText:  "Connection Established",
+			HTTPVersion: r.Proto,
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Comment: "opaque CONNECT tunnel; contents not decrypted",
+	}
+	c.add(entry)
+}
+
+// harTransport wraps an upstream http.RoundTripper, recording a HAR entry
+// for every request/response pair and collecting per-phase timings via an
+// httptrace.ClientTrace.
+type harTransport struct {
+	underlying http.RoundTripper
+	collector  *harCollector
+}
+
+func wrapWithHAR(underlying http.RoundTripper, collector *harCollector) http.RoundTripper {
+	if collector == nil {
+		return underlying
+	}
+	return &harTransport{underlying: underlying, collector: collector}
+}
+
+func (t *harTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	started := time.Now()
+	var dnsStart, dnsDone, connectStart, connectDone, tlsStart, tlsDone, gotConn, wroteReq, firstByte time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn:              func(httptrace.GotConnInfo) { gotConn = time.Now() },
+		DNSStart:              func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:               func(httptrace.DNSDoneInfo) { dnsDone = time.Now() },
+		ConnectStart:          func(string, string) { connectStart = time.Now() },
+		ConnectDone:           func(string, string, error) { connectDone = time.Now() },
+		TLSHandshakeStart:     func() { tlsStart = time.Now() },
+		TLSHandshakeDone:      func(tls.ConnectionState, error) { tlsDone = time.Now() },
+		WroteRequest:          func(httptrace.WroteRequestInfo) { wroteReq = time.Now() },
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+
+	reqBytes, _ := httputil.DumpRequest(r, true)
+	reqBody := extractDumpedBody(reqBytes)
+
+	res, err := t.underlying.RoundTrip(r)
+	if err != nil {
+		return res, err
+	}
+
+	resBytes, _ := httputil.DumpResponse(res, true)
+	resBody := extractDumpedBody(resBytes)
+
+	timing := harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Send: -1, Wait: -1, Receive: -1}
+	if !dnsStart.IsZero() && !dnsDone.IsZero() {
+		timing.DNS = dnsDone.Sub(dnsStart).Seconds() * 1000
+	}
+	if !connectStart.IsZero() && !connectDone.IsZero() {
+		timing.Connect = connectDone.Sub(connectStart).Seconds() * 1000
+	}
+	if !tlsStart.IsZero() && !tlsDone.IsZero() {
+		timing.SSL = tlsDone.Sub(tlsStart).Seconds() * 1000
+	}
+	if !gotConn.IsZero() && !wroteReq.IsZero() {
+		timing.Send = wroteReq.Sub(gotConn).Seconds() * 1000
+	}
+	if !wroteReq.IsZero() && !firstByte.IsZero() {
+		timing.Wait = firstByte.Sub(wroteReq).Seconds() * 1000
+	}
+	if !firstByte.IsZero() {
+		timing.Receive = time.Since(firstByte).Seconds() * 1000
+	}
+
+	t.collector.recordHTTPEntry(r, res, started, reqBody, resBody, timing)
+	return res, nil
+}
+
+// extractDumpedBody splits the body out of a DumpRequest/DumpResponse
+// buffer, which is headers and body separated by a blank line.
+func extractDumpedBody(dump []byte) []byte {
+	if idx := bytes.Index(dump, []byte("\r\n\r\n")); idx >= 0 {
+		return dump[idx+4:]
+	}
+	if idx := bytes.Index(dump, []byte("\n\n")); idx >= 0 {
+		return dump[idx+2:]
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// configureHTTP2Server enables HTTP/2 (over TLS, via ALPN) on server instead
+// of the TLSNextProto override that otherwise forces HTTP/1.1. It is a no-op
+// at the net/http level until the server is actually serving TLS (e.g. via
+// ListenAndServeTLS or the MITM tunnel's own http2.Server), since HTTP/2
+// requires TLS in practice.
+func configureHTTP2Server(server *http.Server) error {
+	return http2.ConfigureServer(server, &http2.Server{})
+}
+
+// serveTunneledHTTP2 is the h2 counterpart of serveTunneledHTTP: it speaks
+// HTTP/2 on both legs of an already ALPN-negotiated MITM tunnel, building
+// its handler with getHTTPHandlerWithTransport like the HTTP/1.1 tunnel and
+// the plain proxy path (and therefore sharing their request/response dump
+// and filter path). net/http already normalizes HTTP/2 pseudo-headers into
+// a regular *http.Request by the time that handler sees it, so no extra
+// translation is needed there.
+//
+// Both conns are wrapped in an idleResetReader so conf.tunnelIdleTimeout
+// bounds them the same way it bounds the plain CONNECT tunnel path, since
+// neither http2.Server.ServeConn nor http2.Transport.NewClientConn apply any
+// idle deadline of their own to the raw conn they're handed.
+func serveTunneledHTTP2(conf config, mw *Proxy, har *harCollector, tracker *drainTracker, clientConn, destConn net.Conn, targetHost string, handleHTTP http.HandlerFunc) {
+	clientConn = &idleResetReader{Conn: clientConn, timeout: conf.tunnelIdleTimeout}
+	destConn = &idleResetReader{Conn: destConn, timeout: conf.tunnelIdleTimeout}
+
+	h2Transport := &http2.Transport{}
+	clientConnForUpstream, err := h2Transport.NewClientConn(destConn)
+	if err != nil {
+		log.Printf("MITM h2: wrapping upstream conn for %v: %v", targetHost, err)
+		return
+	}
+	tunnelHandler := getHTTPHandlerWithTransport(conf, wrapWithHAR(clientConnForUpstream, har), mw, tracker)
+
+	h2Server := &http2.Server{}
+	h2Server.ServeConn(clientConn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Scheme = "https"
+			r.URL.Host = targetHost
+			tunnelHandler(w, r)
+		}),
+	})
+}
+
+// newUpstreamTransport builds the http.RoundTripper used for plain (non-MITM)
+// upstream round trips. With http2Enabled it attempts HTTP/2 via ALPN,
+// falling back to HTTP/1.1 for upstreams that don't support it. upstream
+// resolves config.upstreamProxy: an HTTP(S)/PAC-to-HTTP upstream is wired up
+// via Transport.Proxy as usual, while a SOCKS5 upstream (which
+// Transport.Proxy can't express) is dialed directly in DialContext instead.
+// The returned RoundTripper stashes each request's own URL in its context so
+// dialContextFor can resolve against the real destination rather than
+// guessing at it from the (possibly proxy-own) addr it's handed.
+func newUpstreamTransport(conf config, upstream *upstreamProxyResolver) http.RoundTripper {
+	transport := &http.Transport{
+		ForceAttemptHTTP2: conf.http2Enabled,
+		Proxy:             proxyFuncFor(upstream),
+		DialContext:       dialContextFor(upstream),
+	}
+	return &targetStampingTransport{underlying: transport}
+}
+
+// targetStampingTransport wraps an http.RoundTripper, attaching the
+// request's own URL to its context under dialTargetKey before handing it
+// off, so a DialContext built via dialContextFor can recover the real
+// destination even when Transport.Proxy has rewritten addr to the upstream
+// proxy's own address.
+type targetStampingTransport struct {
+	underlying http.RoundTripper
+}
+
+type dialTargetKey struct{}
+
+func (t *targetStampingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx := context.WithValue(r.Context(), dialTargetKey{}, r.URL)
+	return t.underlying.RoundTrip(r.WithContext(ctx))
+}
+
+// dialContextFor adapts upstream into the Transport.DialContext shape, used
+// to reach a SOCKS5 upstream and to honor a PAC script's DIRECT/PROXY
+// decision for the real destination. addr is either the real destination
+// (when proxyFuncFor resolved to upstreamDirect or upstreamSOCKS5, so
+// net/http asked to dial it directly) or an HTTP upstream's own address
+// (when Transport.Proxy already chose one) - in the latter case resolving
+// against addr itself would re-evaluate PAC against the proxy's own host
+// instead of the destination, so we prefer the URL targetStampingTransport
+// stashed in ctx and only fall back to addr if it's missing.
+func dialContextFor(upstream *upstreamProxyResolver) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		target, ok := ctx.Value(dialTargetKey{}).(*url.URL)
+		if !ok {
+			var err error
+			if target, err = url.Parse("https://" + addr); err != nil {
+				return nil, err
+			}
+		}
+		if up, err := upstream.resolve(target); err == nil && up.scheme == upstreamSOCKS5 {
+			return upstream.dial(network, addr, "")
+		}
+		return (&net.Dialer{Timeout: TIMEOUT_MS * time.Millisecond}).DialContext(ctx, network, addr)
+	}
+}
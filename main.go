@@ -3,44 +3,143 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
 	"net/http/httputil"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 const TIMEOUT_MS = 5000
 
-type userAgent struct {
-	ua  string
-	pct float32
-}
 type config struct {
 	logRequestBody  bool
 	logResponseBody bool
 	address         string
 	// logTunnelBytes  bool
+
+	// interceptTLS enables MITM interception of CONNECT tunnels: instead of
+	// blindly piping bytes, the proxy terminates TLS with the client using a
+	// leaf certificate generated on the fly (signed by caCertPath/caKeyPath)
+	// and terminates its own TLS connection to the real upstream, so the
+	// decrypted traffic flows through the normal HTTP handler.
+	interceptTLS bool
+	caCertPath   string
+	caKeyPath    string
+
+	// http2Enabled turns on HTTP/2 for both sides of the proxy: the server
+	// negotiates h2 with TLS clients (including inside MITM tunnels) instead
+	// of forcing HTTP/1.1 via TLSNextProto, and the upstream transport
+	// attempts h2 via ALPN.
+	http2Enabled bool
+
+	// harPath, when set, accumulates every proxied request/response into an
+	// in-memory HAR 1.2 log that is flushed to this path on shutdown (and
+	// additionally every harRotateInterval, if set).
+	harPath           string
+	harRotateInterval time.Duration
+
+	// upstreamProxy, when set, chains this proxy through another one instead
+	// of dialing destinations directly: a "http://", "https://" or
+	// "socks5://" URL (optionally with embedded credentials) names a static
+	// upstream, while "pac+<url>" fetches a PAC file from <url> and
+	// evaluates FindProxyForURL per destination. See upstreamProxyResolver.
+	upstreamProxy string
+
+	// userAgentsPath, when set, loads a weighted userAgent distribution
+	// (JSON array of {"ua": ..., "pct": ...}) that every outbound request's
+	// User-Agent header is rewritten from, instead of passing the client's
+	// header through unchanged. See uaRotator.
+	userAgentsPath string
+	userAgents     []userAgent
+
+	// shutdownGrace bounds how long a SIGINT/SIGTERM shutdown waits for
+	// server.Shutdown and in-flight CONNECT tunnels to finish before
+	// tunnels are force-closed.
+	shutdownGrace time.Duration
+
+	// readHeaderTimeout and idleTimeout are applied to the http.Server so a
+	// client that never finishes sending headers, or goes idle between
+	// keep-alive requests, doesn't hold its connection open forever.
+	readHeaderTimeout time.Duration
+	idleTimeout       time.Duration
+
+	// tunnelIdleTimeout bounds how long either direction of a CONNECT tunnel
+	// may go without forwarding a byte before the whole tunnel is torn down.
+	tunnelIdleTimeout time.Duration
 }
 
 func (c config) String() string {
-	return fmt.Sprintf("Log Req Body:\t%v\nLog Res Body:\t%v\nAddress:\t%v",
+	return fmt.Sprintf("Log Req Body:\t%v\nLog Res Body:\t%v\nAddress:\t%v\nIntercept TLS:\t%v\nHTTP/2:\t%v\nHAR Path:\t%v\nUpstream Proxy:\t%v\nUser Agents:\t%v\nShutdown Grace:\t%v\nTunnel Idle Timeout:\t%v",
 		c.logRequestBody,
 		c.logResponseBody,
-		c.address)
+		c.address,
+		c.interceptTLS,
+		c.http2Enabled,
+		c.harPath,
+		c.upstreamProxy,
+		c.userAgentsPath,
+		c.shutdownGrace,
+		c.tunnelIdleTimeout)
 }
 
 func defaultConfig() config {
 	return config{
-		logRequestBody:  false,
-		logResponseBody: false,
-		address:         ":8888",
+		logRequestBody:    false,
+		logResponseBody:   false,
+		address:           ":8888",
+		interceptTLS:      false,
+		caCertPath:        "./ca-cert.pem",
+		caKeyPath:         "./ca-key.pem",
+		http2Enabled:      false,
+		harPath:           "",
+		harRotateInterval: 0,
+		upstreamProxy:     "",
+		userAgentsPath:    "",
+		shutdownGrace:     10 * time.Second,
+		readHeaderTimeout: 10 * time.Second,
+		idleTimeout:       2 * time.Minute,
+		tunnelIdleTimeout: 5 * time.Minute,
 	}
 }
 
-func handleTunnel(w http.ResponseWriter, r *http.Request) {
+// parseFlags builds a config from defaultConfig, overridden by whatever
+// flags the caller passed on the command line.
+func parseFlags() config {
+	conf := defaultConfig()
+
+	flag.BoolVar(&conf.logRequestBody, "log-request-body", conf.logRequestBody, "log request bodies")
+	flag.BoolVar(&conf.logResponseBody, "log-response-body", conf.logResponseBody, "log response bodies")
+	flag.StringVar(&conf.address, "address", conf.address, "address to listen on")
+
+	flag.BoolVar(&conf.interceptTLS, "intercept-tls", conf.interceptTLS, "MITM-intercept CONNECT tunnels instead of blindly piping them")
+	flag.StringVar(&conf.caCertPath, "ca-cert", conf.caCertPath, "path to the MITM CA certificate (generated if missing)")
+	flag.StringVar(&conf.caKeyPath, "ca-key", conf.caKeyPath, "path to the MITM CA private key (generated if missing)")
+
+	flag.BoolVar(&conf.http2Enabled, "http2", conf.http2Enabled, "enable HTTP/2 on both the server and upstream transport")
+
+	flag.StringVar(&conf.harPath, "har-path", conf.harPath, "path to flush a HAR 1.2 capture of proxied traffic to (disabled if empty)")
+	flag.DurationVar(&conf.harRotateInterval, "har-rotate-interval", conf.harRotateInterval, "how often to also rewrite the HAR capture file with everything captured so far (0 writes it only on shutdown)")
+
+	flag.StringVar(&conf.upstreamProxy, "upstream-proxy", conf.upstreamProxy, `upstream proxy to chain through: a "http://", "https://" or "socks5://" URL, or "pac+<url>" (disabled if empty)`)
+
+	flag.StringVar(&conf.userAgentsPath, "user-agents", conf.userAgentsPath, "path to a JSON list of weighted User-Agent entries to rotate through (disabled if empty)")
+
+	flag.DurationVar(&conf.shutdownGrace, "shutdown-grace", conf.shutdownGrace, "how long to wait for in-flight requests and tunnels to drain on shutdown")
+	flag.DurationVar(&conf.readHeaderTimeout, "read-header-timeout", conf.readHeaderTimeout, "timeout for reading a client's request headers")
+	flag.DurationVar(&conf.idleTimeout, "idle-timeout", conf.idleTimeout, "how long a keep-alive connection may sit idle between requests")
+	flag.DurationVar(&conf.tunnelIdleTimeout, "tunnel-idle-timeout", conf.tunnelIdleTimeout, "how long a CONNECT tunnel may go without forwarding a byte before it is torn down")
+
+	flag.Parse()
+	return conf
+}
+
+func handleTunnel(conf config, mitm *mitmInterceptor, upstream *upstreamProxyResolver, tracker *drainTracker, mw *Proxy, har *harCollector, handleHTTP http.HandlerFunc, w http.ResponseWriter, r *http.Request) {
 	log.Printf("Tunneling connection:\n\tClient=%v, Target=%v", r.RemoteAddr, r.Host)
 	reqBytes, err := httputil.DumpRequest(r, true)
 	if err != nil {
@@ -48,8 +147,20 @@ func handleTunnel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Printf("Tunnel Req Bytes:\n%v\n", reqBytes)
-	// Establish a connection with the target server
-	destConn, err := net.DialTimeout("tcp", r.Host, TIMEOUT_MS*time.Millisecond)
+
+	if conf.interceptTLS {
+		handleMITMTunnel(conf, mitm, upstream, tracker, mw, har, handleHTTP, w, r)
+		return
+	}
+
+	if har != nil {
+		har.recordTunnelEntry(r, time.Now())
+	}
+
+	// Establish a connection with the target server, chaining through the
+	// configured upstream proxy (if any) and forwarding the client's own
+	// Proxy-Authorization header to it.
+	destConn, err := upstream.dial("tcp", r.Host, r.Header.Get("Proxy-Authorization"))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
@@ -65,23 +176,26 @@ func handleTunnel(w http.ResponseWriter, r *http.Request) {
 	clientConn, _, err := hijacker.Hijack()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		destConn.Close()
+		return
 	}
-	// At this point, we have connection to client, and connection to server
-	// Forward messages from client->target and target->client
-	go transfer(clientConn, destConn)
-	go transfer(destConn, clientConn)
-}
-
-func transfer(from io.ReadCloser, to io.WriteCloser) {
-	defer to.Close()
-	defer from.Close()
-	// dest, src
-	io.Copy(to, from)
+	// At this point, we have connection to client, and connection to server.
+	// Forward messages from client->target and target->client, tracked so a
+	// graceful shutdown can wait for (or force-close) this tunnel.
+	runTunnel(tracker, clientConn, destConn, conf.tunnelIdleTimeout)
 }
 
-func getHTTPHandler(conf config) func(http.ResponseWriter, *http.Request) {
+// getHTTPHandlerWithTransport round-trips requests through the given
+// transport and runs every request/response through mw's handler chain in
+// place of a hard-coded filter. This lets the MITM tunnel path reuse its
+// already-established upstream TLS connection instead of dialing a fresh one
+// per request, while still sharing the same interceptor chain as the plain
+// path. tracker counts the request as in flight for the duration of the
+// round trip, so a graceful shutdown has visibility into it.
+func getHTTPHandlerWithTransport(conf config, transport http.RoundTripper, mw *Proxy, tracker *drainTracker) func(http.ResponseWriter, *http.Request) {
 	handler :=
 		func(w http.ResponseWriter, r *http.Request) {
+			defer tracker.trackHTTP()()
 			log.Printf("HTTP connection:\n\tClient=%v, Target=%v\n", r.RemoteAddr, r.Host)
 			reqBytes, err := httputil.DumpRequest(r, conf.logRequestBody)
 			if err != nil {
@@ -89,10 +203,14 @@ func getHTTPHandler(conf config) func(http.ResponseWriter, *http.Request) {
 				return
 			}
 			log.Printf("HTTP Req:\n%v\n", string(reqBytes))
-			res, err := http.DefaultTransport.RoundTrip(r)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusServiceUnavailable)
-				return
+
+			r, res := mw.handleRequest(r)
+			if res == nil {
+				res, err = transport.RoundTrip(r)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusServiceUnavailable)
+					return
+				}
 			}
 
 			middleResBytes, err := httputil.DumpResponse(res, conf.logResponseBody)
@@ -103,8 +221,8 @@ func getHTTPHandler(conf config) func(http.ResponseWriter, *http.Request) {
 
 			log.Printf("HTTP Raw Res:\n%v\n", string(middleResBytes))
 			defer res.Body.Close()
-			finalRes := filterResponse(*res)
-			finalResBytes, err := httputil.DumpResponse(&finalRes, conf.logResponseBody)
+			finalRes := mw.handleResponse(res, r)
+			finalResBytes, err := httputil.DumpResponse(finalRes, conf.logResponseBody)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -117,71 +235,6 @@ func getHTTPHandler(conf config) func(http.ResponseWriter, *http.Request) {
 	return handler
 }
 
-type set struct {
-	entries map[string]struct{}
-}
-
-func newSet() *set {
-	entries := make(map[string]struct{})
-	return &set{entries: entries}
-}
-func (s set) has(val string) bool {
-	_, ok := s.entries[val]
-	return ok
-}
-func (s set) insert(val string) bool {
-	if s.has(val) {
-		return false
-	}
-	s.entries[val] = struct{}{}
-	return true
-}
-
-type headerEntry struct {
-	key    string
-	values []string
-}
-
-func withoutHeaders(in <-chan headerEntry, unwanted set) <-chan headerEntry {
-	out := make(chan headerEntry)
-	go func() {
-		defer close(out)
-		for entry := range in {
-			if !unwanted.has(entry.key) {
-				out <- entry
-			}
-		}
-	}()
-	// for header, _ := range unwanted {
-	// 	delete(h, header)
-	// }
-	return out
-}
-func filterResponse(response http.Response) http.Response {
-	filteredRes := response
-	headerCh := make(chan headerEntry)
-	unwantedHeaders := newSet()
-	if unwantedHeaders == nil {
-		log.Fatalf("Unwanted Headers set is nil")
-	}
-	unwantedHeaders.insert("Cookie")
-	go func() {
-		defer close(headerCh)
-		for k, vals := range response.Header {
-			headerCh <- headerEntry{key: http.CanonicalHeaderKey(k), values: vals}
-		}
-	}()
-	filteredHeaderCh := withoutHeaders(headerCh, *unwantedHeaders)
-	go func() {
-		for h := range filteredHeaderCh {
-			for _, v := range h.values {
-				filteredRes.Header.Add(h.key, v)
-			}
-		}
-	}()
-	return filteredRes
-}
-
 func copyHeader(from, to http.Header) {
 	for k, headers := range from {
 		for _, header := range headers {
@@ -198,42 +251,108 @@ func logRequest(r *http.Request, withBody bool) error {
 	log.Printf("\n->Request:\n%v\n", string(reqBytes))
 	return nil
 }
-func run() {
-	conf := defaultConfig()
+func run(conf config) {
 	log.Println("GO FORWARD HTTP(S) PROXY")
+
+	if conf.userAgentsPath != "" {
+		uas, err := loadUserAgents(conf.userAgentsPath)
+		if err != nil {
+			log.Fatalf("failed to load user agent list: %v", err)
+		}
+		conf.userAgents = uas
+	}
 	log.Printf("using config:\n%v\n", conf)
 
-	handleHTTP := getHTTPHandler(conf)
+	mw := defaultProxy()
+
+	var uaStats *uaRotator
+	if len(conf.userAgents) > 0 {
+		var err error
+		uaStats, err = newUARotator(conf.userAgents)
+		if err != nil {
+			log.Fatalf("failed to configure user agent rotation: %v", err)
+		}
+		mw.OnRequest().Do(RotateUserAgent(uaStats))
+	}
+
+	var har *harCollector
+	if conf.harPath != "" {
+		har = newHARCollector(conf.harPath, conf.harRotateInterval)
+		defer har.Close()
+	}
+
+	upstream, err := newUpstreamProxyResolver(conf.upstreamProxy)
+	if err != nil {
+		log.Fatalf("failed to configure upstream proxy: %v", err)
+	}
+
+	tracker := newDrainTracker()
+
+	upstreamTransport := wrapWithHAR(newUpstreamTransport(conf, upstream), har)
+	handleHTTP := getHTTPHandlerWithTransport(conf, upstreamTransport, mw, tracker)
+
+	var mitm *mitmInterceptor
+	if conf.interceptTLS {
+		var err error
+		mitm, err = newMITMInterceptor(conf.caCertPath, conf.caKeyPath)
+		if err != nil {
+			log.Fatalf("failed to initialize MITM interceptor: %v", err)
+		}
+	}
 
 	server := &http.Server{
-		Addr: conf.address,
+		Addr:              conf.address,
+		ReadHeaderTimeout: conf.readHeaderTimeout,
+		IdleTimeout:       conf.idleTimeout,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if uaStats != nil && r.Method == http.MethodGet && r.URL.Path == uaStatsPath {
+				serveUAStats(uaStats, w, r)
+				return
+			}
 			log.Printf("Connection:\n\tClient=%v, Target=%v", r.RemoteAddr, r.Host)
 			logRequest(r, conf.logRequestBody)
 			// when proxy=http and target=https, it will tunnel
 			if r.Method == http.MethodConnect {
-				handleTunnel(w, r)
+				handleTunnel(conf, mitm, upstream, tracker, mw, har, handleHTTP, w, r)
 			} else {
 				// when proxy=http && target=http
 				handleHTTP(w, r)
 			}
 		}),
+	}
+	if !conf.http2Enabled {
 		// Disables HTTP/2
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	} else if err := configureHTTP2Server(server); err != nil {
+		log.Fatalf("failed to configure HTTP/2 on server: %v", err)
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	go func() {
 		// log.Fatal(server.ListenAndServeTLS("./certificate.pem", "./privatekey.pem"))
-		log.Fatal(server.ListenAndServe())
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("server error: %v", err)
+		}
 	}()
-	fmt.Println("Server started, press <Enter> to shutdown")
-	fmt.Scanln()
-	server.Shutdown(context.Background())
+	fmt.Println("Server started, press Ctrl+C to shut down")
+
+	<-ctx.Done()
+	stop()
+	log.Printf("shutdown signal received (in-flight HTTP requests: %v), draining\n", tracker.httpInFlight.Load())
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), conf.shutdownGrace)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("server shutdown: %v", err)
+	}
+	deadline, _ := shutdownCtx.Deadline()
+	tracker.drain(time.Until(deadline))
 	fmt.Println("Server stopped")
 	// log.Fatal(server.ListenAndServe())
 }
 
 func main() {
-	// logReq := flag.Bool("")
-	run()
-}
\ No newline at end of file
+	run(parseFlags())
+}
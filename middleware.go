@@ -0,0 +1,243 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ReqHandler inspects or rewrites an outbound request. If it returns a
+// non-nil *http.Response, that response short-circuits the round trip (the
+// request is never sent upstream) and the response is used in its place.
+type ReqHandler func(*http.Request) (*http.Request, *http.Response)
+
+// RespHandler inspects or rewrites an inbound response before it is sent
+// back to the client.
+type RespHandler func(*http.Response, *http.Request) *http.Response
+
+// ReqMatcher decides whether a handler applies to a given request. Matchers
+// are combined with AND within a single OnRequest/OnResponse call.
+type ReqMatcher func(*http.Request) bool
+
+type reqCondition struct {
+	matchers []ReqMatcher
+	handler  ReqHandler
+}
+
+type respCondition struct {
+	matchers []ReqMatcher
+	handler  RespHandler
+}
+
+// Proxy holds the ordered chain of request/response handlers that every
+// proxied request passes through, modeled on goproxy's
+// OnRequest().Do(...)/OnResponse().Do(...) chaining. It replaces the old
+// hard-coded filterResponse, which silently did nothing because it wrote the
+// "filtered" headers back into the same map it was filtering out of.
+type Proxy struct {
+	reqConditions  []reqCondition
+	respConditions []respCondition
+}
+
+// NewProxy returns an empty handler chain; every request passes through
+// unmodified until handlers are registered via OnRequest/OnResponse.
+func NewProxy() *Proxy {
+	return &Proxy{}
+}
+
+// ReqConditionBuilder accumulates the matchers passed to OnRequest until Do
+// attaches the handler that runs when they all match.
+type ReqConditionBuilder struct {
+	proxy    *Proxy
+	matchers []ReqMatcher
+}
+
+// OnRequest starts a request handler registration: p.OnRequest(matchers...).Do(handler).
+func (p *Proxy) OnRequest(matchers ...ReqMatcher) *ReqConditionBuilder {
+	return &ReqConditionBuilder{proxy: p, matchers: matchers}
+}
+
+// Do registers handler to run, in order, for every request matched by the
+// preceding OnRequest call.
+func (b *ReqConditionBuilder) Do(handler ReqHandler) {
+	b.proxy.reqConditions = append(b.proxy.reqConditions, reqCondition{matchers: b.matchers, handler: handler})
+}
+
+// RespConditionBuilder is the OnResponse counterpart of ReqConditionBuilder.
+type RespConditionBuilder struct {
+	proxy    *Proxy
+	matchers []ReqMatcher
+}
+
+// OnResponse starts a response handler registration: p.OnResponse(matchers...).Do(handler).
+// Matchers are evaluated against the request the response belongs to.
+func (p *Proxy) OnResponse(matchers ...ReqMatcher) *RespConditionBuilder {
+	return &RespConditionBuilder{proxy: p, matchers: matchers}
+}
+
+// Do registers handler to run, in order, for every response whose request
+// was matched by the preceding OnResponse call.
+func (b *RespConditionBuilder) Do(handler RespHandler) {
+	b.proxy.respConditions = append(b.proxy.respConditions, respCondition{matchers: b.matchers, handler: handler})
+}
+
+func matchesAll(matchers []ReqMatcher, r *http.Request) bool {
+	for _, m := range matchers {
+		if !m(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleRequest runs r through the request handler chain in registration
+// order. If a handler short-circuits with a response, that response (and
+// whatever the request was rewritten to up to that point) is returned
+// immediately and no further request handlers run.
+func (p *Proxy) handleRequest(r *http.Request) (*http.Request, *http.Response) {
+	for _, cond := range p.reqConditions {
+		if !matchesAll(cond.matchers, r) {
+			continue
+		}
+		var res *http.Response
+		r, res = cond.handler(r)
+		if res != nil {
+			return r, res
+		}
+	}
+	return r, nil
+}
+
+// handleResponse runs res through the response handler chain in
+// registration order, threading the (possibly rewritten) response from one
+// handler to the next.
+func (p *Proxy) handleResponse(res *http.Response, r *http.Request) *http.Response {
+	for _, cond := range p.respConditions {
+		if !matchesAll(cond.matchers, r) {
+			continue
+		}
+		res = cond.handler(res, r)
+	}
+	return res
+}
+
+// Built-in matchers.
+
+// MatchHost matches requests whose Host satisfies the given glob (as
+// interpreted by path.Match), e.g. "*.example.com".
+func MatchHost(glob string) ReqMatcher {
+	return func(r *http.Request) bool {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		ok, _ := path.Match(glob, host)
+		return ok
+	}
+}
+
+// MatchPath matches requests whose URL path satisfies re.
+func MatchPath(re *regexp.Regexp) ReqMatcher {
+	return func(r *http.Request) bool {
+		return re.MatchString(r.URL.Path)
+	}
+}
+
+// MatchMethod matches requests with the given HTTP method.
+func MatchMethod(method string) ReqMatcher {
+	return func(r *http.Request) bool {
+		return strings.EqualFold(r.Method, method)
+	}
+}
+
+// MatchContentType matches requests whose Content-Type header contains substr.
+func MatchContentType(substr string) ReqMatcher {
+	return func(r *http.Request) bool {
+		return strings.Contains(r.Header.Get("Content-Type"), substr)
+	}
+}
+
+// Built-in actions.
+
+// DropRequestHeader removes header from the outbound request.
+func DropRequestHeader(header string) ReqHandler {
+	return func(r *http.Request) (*http.Request, *http.Response) {
+		r.Header.Del(header)
+		return r, nil
+	}
+}
+
+// DropResponseHeader removes header from the response sent back to the client.
+func DropResponseHeader(header string) RespHandler {
+	return func(res *http.Response, r *http.Request) *http.Response {
+		res.Header.Del(header)
+		return res
+	}
+}
+
+// RewriteRequestHeader sets header to value on the outbound request.
+func RewriteRequestHeader(header, value string) ReqHandler {
+	return func(r *http.Request) (*http.Request, *http.Response) {
+		r.Header.Set(header, value)
+		return r, nil
+	}
+}
+
+// CannedResponse short-circuits the request with a fixed status and body,
+// without ever contacting the upstream.
+func CannedResponse(status int, body string) ReqHandler {
+	return func(r *http.Request) (*http.Request, *http.Response) {
+		res := &http.Response{
+			StatusCode: status,
+			Status:     http.StatusText(status),
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    r,
+		}
+		return r, res
+	}
+}
+
+// RewriteURL rewrites the request's destination URL in place, e.g. to
+// redirect traffic to a different host or path.
+func RewriteURL(rewrite func(*url.URL)) ReqHandler {
+	return func(r *http.Request) (*http.Request, *http.Response) {
+		rewrite(r.URL)
+		r.Host = r.URL.Host
+		return r, nil
+	}
+}
+
+// InjectDelay sleeps for d before letting the request continue, useful for
+// simulating slow upstreams.
+func InjectDelay(d time.Duration) ReqHandler {
+	return func(r *http.Request) (*http.Request, *http.Response) {
+		time.Sleep(d)
+		return r, nil
+	}
+}
+
+// defaultProxy builds the handler chain used by run(): strip Set-Cookie from
+// responses, and tag every outbound request with a Via header identifying
+// this proxy.
+func defaultProxy() *Proxy {
+	p := NewProxy()
+	p.OnResponse().Do(DropResponseHeader("Set-Cookie"))
+	p.OnRequest().Do(RewriteRequestHeader("Via", "go-forward-http"))
+	return p
+}
+
+// BlockDomain short-circuits every request it is applied to with a 403; pair
+// it with MatchHost to choose the hosts, e.g.
+// p.OnRequest(MatchHost("*.ads.example.com")).Do(BlockDomain()).
+func BlockDomain() ReqHandler {
+	return CannedResponse(http.StatusForbidden, "blocked by proxy policy")
+}
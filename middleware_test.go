@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyHandleRequestMatchingAndOrder(t *testing.T) {
+	p := NewProxy()
+	var order []string
+	p.OnRequest(MatchMethod("GET")).Do(func(r *http.Request) (*http.Request, *http.Response) {
+		order = append(order, "first")
+		return r, nil
+	})
+	p.OnRequest(MatchHost("*.example.com")).Do(func(r *http.Request) (*http.Request, *http.Response) {
+		order = append(order, "second")
+		return r, nil
+	})
+	p.OnRequest(MatchMethod("POST")).Do(func(r *http.Request) (*http.Request, *http.Response) {
+		order = append(order, "never")
+		return r, nil
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "http://api.example.com/", nil)
+	r.Host = "api.example.com"
+	if _, res := p.handleRequest(r); res != nil {
+		t.Fatalf("handleRequest returned a short-circuit response, want none")
+	}
+	if want := []string{"first", "second"}; !equalStrings(order, want) {
+		t.Fatalf("handler order = %v, want %v", order, want)
+	}
+}
+
+func TestProxyHandleRequestShortCircuitStopsChain(t *testing.T) {
+	p := NewProxy()
+	ran := false
+	p.OnRequest().Do(BlockDomain())
+	p.OnRequest().Do(func(r *http.Request) (*http.Request, *http.Response) {
+		ran = true
+		return r, nil
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "http://ads.example.com/", nil)
+	_, res := p.handleRequest(r)
+	if res == nil {
+		t.Fatalf("handleRequest did not short-circuit")
+	}
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("status = %v, want %v", res.StatusCode, http.StatusForbidden)
+	}
+	if ran {
+		t.Fatalf("handler after the short-circuiting one still ran")
+	}
+}
+
+func TestDropResponseHeaderRemovesHeader(t *testing.T) {
+	p := defaultProxy()
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	res := &http.Response{Header: make(http.Header)}
+	res.Header.Set("Set-Cookie", "id=1")
+	res.Header.Set("Content-Type", "text/plain")
+
+	out := p.handleResponse(res, r)
+	if out.Header.Get("Set-Cookie") != "" {
+		t.Fatalf("Set-Cookie header still present: %v", out.Header.Get("Set-Cookie"))
+	}
+	if out.Header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("unrelated header was dropped")
+	}
+}
+
+func TestMatchHostGlob(t *testing.T) {
+	m := MatchHost("*.example.com")
+	cases := []struct {
+		host string
+		want bool
+	}{
+		{"api.example.com", true},
+		{"api.example.com:443", true},
+		{"example.com", false},
+		{"example.org", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "http://"+c.host+"/", nil)
+		r.Host = c.host
+		if got := m(r); got != c.want {
+			t.Errorf("MatchHost(%q) for host %q = %v, want %v", "*.example.com", c.host, got, c.want)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// leafCertTTL controls how long a generated leaf certificate is reused for a
+// given host before it is regenerated.
+const leafCertTTL = 1 * time.Hour
+
+// mitmInterceptor holds the CA used to sign on-the-fly leaf certificates and
+// a cache of the leaves it has already generated, keyed by SNI/host.
+type mitmInterceptor struct {
+	caCert *x509.Certificate
+	caKey  *rsa.PrivateKey
+	caTLS  tls.Certificate
+
+	mu    sync.Mutex
+	cache map[string]cachedLeaf
+}
+
+type cachedLeaf struct {
+	cert      *tls.Certificate
+	expiresAt time.Time
+}
+
+// newMITMInterceptor loads the CA keypair at certPath/keyPath, generating and
+// persisting a new self-signed CA the first time it is run.
+func newMITMInterceptor(certPath, keyPath string) (*mitmInterceptor, error) {
+	caTLS, caCert, caKey, err := loadOrGenerateCA(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return &mitmInterceptor{
+		caCert: caCert,
+		caKey:  caKey,
+		caTLS:  caTLS,
+		cache:  make(map[string]cachedLeaf),
+	}, nil
+}
+
+func loadOrGenerateCA(certPath, keyPath string) (tls.Certificate, *x509.Certificate, *rsa.PrivateKey, error) {
+	if _, err := os.Stat(certPath); err == nil {
+		if _, err := os.Stat(keyPath); err == nil {
+			return loadCA(certPath, keyPath)
+		}
+	}
+	log.Printf("no CA found at %v, generating a new one", certPath)
+	return generateCA(certPath, keyPath)
+}
+
+func loadCA(certPath, keyPath string) (tls.Certificate, *x509.Certificate, *rsa.PrivateKey, error) {
+	caTLS, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return tls.Certificate{}, nil, nil, fmt.Errorf("loading CA keypair: %w", err)
+	}
+	caCert, err := x509.ParseCertificate(caTLS.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, nil, nil, fmt.Errorf("parsing CA cert: %w", err)
+	}
+	caKey, ok := caTLS.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return tls.Certificate{}, nil, nil, fmt.Errorf("CA key at %v is not RSA", keyPath)
+	}
+	return caTLS, caCert, caKey, nil
+}
+
+func generateCA(certPath, keyPath string) (tls.Certificate, *x509.Certificate, *rsa.PrivateKey, error) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, nil, nil, fmt.Errorf("generating CA key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, nil, nil, fmt.Errorf("generating CA serial: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "go-forward-http MITM CA",
+			Organization: []string{"go-forward-http"},
+		},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, nil, nil, fmt.Errorf("creating CA cert: %w", err)
+	}
+	if err := writePEM(certPath, "CERTIFICATE", der); err != nil {
+		return tls.Certificate{}, nil, nil, err
+	}
+	if err := writePEM(keyPath, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(caKey)); err != nil {
+		return tls.Certificate{}, nil, nil, err
+	}
+	return loadCA(certPath, keyPath)
+}
+
+func writePEM(path, blockType string, der []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("writing %v: %w", path, err)
+	}
+	defer f.Close()
+	return pem.Encode(f, &pem.Block{Type: blockType, Bytes: der})
+}
+
+// leafFor returns a leaf certificate for host, generating and caching one
+// signed by the CA if none is cached yet or the cached one has expired.
+func (m *mitmInterceptor) leafFor(host string) (*tls.Certificate, error) {
+	m.mu.Lock()
+	if leaf, ok := m.cache[host]; ok && time.Now().Before(leaf.expiresAt) {
+		m.mu.Unlock()
+		return leaf.cert, nil
+	}
+	m.mu.Unlock()
+
+	cert, err := m.generateLeaf(host)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.cache[host] = cachedLeaf{cert: cert, expiresAt: time.Now().Add(leafCertTTL)}
+	m.mu.Unlock()
+	return cert, nil
+}
+
+func (m *mitmInterceptor) generateLeaf(host string) (*tls.Certificate, error) {
+	leafKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("generating leaf key for %v: %w", host, err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generating leaf serial for %v: %w", host, err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(leafCertTTL * 24),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, m.caCert, &leafKey.PublicKey, m.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("signing leaf for %v: %w", host, err)
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, m.caCert.Raw},
+		PrivateKey:  leafKey,
+	}
+	return cert, nil
+}
+
+// handleMITMTunnel terminates TLS with the client using a leaf certificate
+// generated for the tunneled host, terminates its own TLS connection to the
+// real upstream, and serves every request that flows through the
+// now-decrypted tunnel with a handler built by getHTTPHandlerWithTransport
+// over that upstream connection (the same handler chain handleHTTP uses).
+func handleMITMTunnel(conf config, mitm *mitmInterceptor, upstream *upstreamProxyResolver, tracker *drainTracker, mw *Proxy, har *harCollector, handleHTTP http.HandlerFunc, w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Tunneling (hijacking) not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer clientConn.Close()
+
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		log.Printf("MITM: writing 200 to client for %v: %v", r.Host, err)
+		return
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = host
+			}
+			return mitm.leafFor(name)
+		},
+	}
+	if conf.http2Enabled {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	tlsClientConn := tls.Server(clientConn, tlsConfig)
+	if err := tlsClientConn.Handshake(); err != nil {
+		log.Printf("MITM: TLS handshake with client for %v: %v", r.Host, err)
+		return
+	}
+	defer tlsClientConn.Close()
+
+	// Only offer h2 to the upstream if the client itself actually negotiated
+	// it with us: singleConnTransport (the serveTunneledHTTP fallback) writes
+	// plain HTTP/1.1 text framing onto destConn, which breaks the instant an
+	// h2-capable upstream is allowed to ALPN-negotiate h2 on a leg serving an
+	// h1-only client.
+	upstreamTLSConfig := &tls.Config{ServerName: host}
+	if conf.http2Enabled && tlsClientConn.ConnectionState().NegotiatedProtocol == "h2" {
+		upstreamTLSConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	destConn, err := upstream.dialTLS(r.Host, upstreamTLSConfig, r.Header.Get("Proxy-Authorization"))
+	if err != nil {
+		log.Printf("MITM: TLS dial to upstream %v: %v", r.Host, err)
+		return
+	}
+	defer destConn.Close()
+
+	// Track both conns for as long as the tunnel is open (the calls below
+	// block until it closes), so a graceful shutdown waits for (or
+	// force-closes) MITM tunnels the same way it does plain CONNECT ones.
+	release := tracker.trackTunnel(tlsClientConn, destConn)
+	defer release()
+
+	if conf.http2Enabled &&
+		tlsClientConn.ConnectionState().NegotiatedProtocol == "h2" &&
+		destConn.ConnectionState().NegotiatedProtocol == "h2" {
+		serveTunneledHTTP2(conf, mw, har, tracker, tlsClientConn, destConn, r.Host, handleHTTP)
+		return
+	}
+
+	serveTunneledHTTP(conf, mw, har, tracker, tlsClientConn, destConn, r.Host, handleHTTP)
+}
+
+// serveTunneledHTTP serves HTTP requests read off clientConn, round-tripping
+// each one over destConn (the already-established upstream TLS connection)
+// via the same handler path getHTTPHandlerWithTransport builds for the plain
+// proxy, rather than blindly piping
+// bytes like the plain CONNECT tunnel does.
+//
+// http.Server.Serve returns as soon as it has handed the one connection our
+// oneShotListener ever yields to its per-connection goroutine and made its
+// second, failing Accept call - not when that goroutine is actually done
+// with the connection. Returning on Serve alone would race handleMITMTunnel's
+// deferred Close calls against a response that hasn't been written yet, so
+// we additionally wait for ConnState to report the connection closed.
+func serveTunneledHTTP(conf config, mw *Proxy, har *harCollector, tracker *drainTracker, clientConn net.Conn, destConn net.Conn, targetHost string, handleHTTP http.HandlerFunc) {
+	transport := wrapWithHAR(&singleConnTransport{conn: destConn}, har)
+	tunnelHandler := getHTTPHandlerWithTransport(conf, transport, mw, tracker)
+
+	connClosed := make(chan struct{})
+	listener := newOneShotListener(clientConn)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Scheme = "https"
+			r.URL.Host = targetHost
+			tunnelHandler(w, r)
+		}),
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				close(connClosed)
+			}
+		},
+		// Same deadlines the main server applies (main.go), so a client that
+		// opens an MITM-intercepted CONNECT and then sends nothing (or a slow
+		// partial request) can't tie up this tunnel's goroutine and sockets
+		// forever the way the plain-tunnel path already guards against via
+		// tunnelIdleTimeout.
+		ReadHeaderTimeout: conf.readHeaderTimeout,
+		IdleTimeout:       conf.idleTimeout,
+	}
+	if err := server.Serve(listener); err != nil && err != errOneShotDone {
+		log.Printf("MITM: serving tunneled requests for %v: %v", targetHost, err)
+	}
+	<-connClosed
+}
+
+// singleConnTransport is an http.RoundTripper backed by a single persistent
+// connection to the upstream server, used so that all requests inside one
+// MITM tunnel share the TLS connection already dialed for it.
+type singleConnTransport struct {
+	conn net.Conn
+	mu   sync.Mutex
+	br   *bufio.Reader
+}
+
+func (t *singleConnTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.br == nil {
+		t.br = bufio.NewReader(t.conn)
+	}
+	if err := r.Write(t.conn); err != nil {
+		return nil, fmt.Errorf("writing tunneled request: %w", err)
+	}
+	return http.ReadResponse(t.br, r)
+}
+
+var errOneShotDone = fmt.Errorf("one-shot listener exhausted")
+
+// oneShotListener adapts a single already-established net.Conn to the
+// net.Listener interface so it can be driven by http.Server.Serve, which
+// wants to Accept connections rather than be handed one directly.
+type oneShotListener struct {
+	conn   net.Conn
+	done   chan struct{}
+	closed bool
+	mu     sync.Mutex
+}
+
+func newOneShotListener(conn net.Conn) *oneShotListener {
+	return &oneShotListener{conn: conn, done: make(chan struct{})}
+}
+
+func (l *oneShotListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, errOneShotDone
+	default:
+	}
+	close(l.done)
+	return l.conn, nil
+}
+
+func (l *oneShotListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+	}
+	return nil
+}
+
+func (l *oneShotListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
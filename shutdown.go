@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// drainTracker tracks in-flight work so run() can wait for it, up to a
+// grace period, before the process actually exits on SIGINT/SIGTERM:
+// httpInFlight counts active plain-HTTP round trips (including those inside
+// an MITM tunnel), and tunnels is the set of live CONNECT tunnel
+// connections, closed forcibly if they haven't drained naturally by the
+// time the grace period elapses.
+type drainTracker struct {
+	httpInFlight atomic.Int64
+
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	tunnels map[net.Conn]struct{}
+}
+
+func newDrainTracker() *drainTracker {
+	return &drainTracker{tunnels: make(map[net.Conn]struct{})}
+}
+
+// trackHTTP marks one HTTP round trip as in flight; call the returned func
+// (typically via defer) when it completes.
+func (d *drainTracker) trackHTTP() func() {
+	d.httpInFlight.Add(1)
+	return func() { d.httpInFlight.Add(-1) }
+}
+
+// trackTunnel registers conns as belonging to one live CONNECT tunnel.
+// Callers must invoke the returned release func exactly once, when every
+// goroutine forwarding bytes over conns has exited.
+func (d *drainTracker) trackTunnel(conns ...net.Conn) func() {
+	d.wg.Add(1)
+	d.mu.Lock()
+	for _, c := range conns {
+		d.tunnels[c] = struct{}{}
+	}
+	d.mu.Unlock()
+	return func() {
+		d.mu.Lock()
+		for _, c := range conns {
+			delete(d.tunnels, c)
+		}
+		d.mu.Unlock()
+		d.wg.Done()
+	}
+}
+
+// drain waits up to grace for every tracked tunnel to finish on its own; any
+// still open once grace elapses are force-closed so the blocked io.Copy
+// calls in transfer return and their goroutines exit, then drain waits for
+// that to actually happen.
+func (d *drainTracker) drain(grace time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(grace):
+	}
+
+	d.mu.Lock()
+	for c := range d.tunnels {
+		c.Close()
+	}
+	d.mu.Unlock()
+	<-done
+}
+
+// runTunnel pipes bytes between clientConn and destConn in both directions
+// until one side closes, tracked by tracker so a shutdown can wait for (or
+// force-close) it, and with idleTimeout enforced on each direction so a
+// tunnel that goes quiet doesn't leak its sockets forever.
+func runTunnel(tracker *drainTracker, clientConn, destConn net.Conn, idleTimeout time.Duration) {
+	release := tracker.trackTunnel(clientConn, destConn)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); transfer(clientConn, destConn, idleTimeout) }()
+	go func() { defer wg.Done(); transfer(destConn, clientConn, idleTimeout) }()
+	go func() {
+		wg.Wait()
+		release()
+	}()
+}
+
+// transfer copies from->to until EOF or error, resetting from's read
+// deadline to idleTimeout (if set) before every read, and closes both ends
+// once the copy stops so the tunnel's other direction unblocks too.
+func transfer(from, to net.Conn, idleTimeout time.Duration) {
+	defer to.Close()
+	defer from.Close()
+	io.Copy(to, &idleResetReader{Conn: from, timeout: idleTimeout})
+}
+
+// idleResetReader wraps a net.Conn so every Read pushes its read deadline
+// forward by timeout, turning a connection with no activity for that long
+// into a read error instead of a goroutine blocked forever.
+type idleResetReader struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (r *idleResetReader) Read(p []byte) (int, error) {
+	if r.timeout > 0 {
+		r.Conn.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+	return r.Conn.Read(p)
+}
+
+// ConnectionState forwards to the wrapped conn's tls.ConnectionState, if it
+// has one, so wrapping a *tls.Conn in an idleResetReader (e.g. to hand it
+// directly to an HTTP/2 client/server that reads the conn itself) doesn't
+// hide its TLS state from callers that type-assert for it.
+func (r *idleResetReader) ConnectionState() tls.ConnectionState {
+	if tc, ok := r.Conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return tc.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
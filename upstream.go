@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertkrimen/otto"
+	xproxy "golang.org/x/net/proxy"
+)
+
+// upstreamScheme identifies how a resolved upstream should be reached.
+type upstreamScheme int
+
+const (
+	upstreamDirect upstreamScheme = iota
+	upstreamHTTP
+	upstreamSOCKS5
+)
+
+// resolvedUpstream is what config.upstreamProxy (or a PAC lookup) resolves
+// to for a single destination.
+type resolvedUpstream struct {
+	scheme upstreamScheme
+	addr   string // host:port, empty for upstreamDirect
+	user   string
+	pass   string
+}
+
+// upstreamProxyResolver knows how to turn a destination URL into the
+// upstream (if any) the proxy should chain through, per config.upstreamProxy.
+// A static "http://", "https://" or "socks5://" value always resolves to the
+// same upstream; a "pac+..." value evaluates a fetched PAC script per
+// destination, with results cached by host.
+type upstreamProxyResolver struct {
+	static *resolvedUpstream // nil if PAC-driven
+	pac    *pacResolver      // nil if statically configured
+}
+
+// newUpstreamProxyResolver parses config.upstreamProxy. An empty string
+// means "no chaining, dial destinations directly".
+func newUpstreamProxyResolver(raw string) (*upstreamProxyResolver, error) {
+	if raw == "" {
+		return &upstreamProxyResolver{static: &resolvedUpstream{scheme: upstreamDirect}}, nil
+	}
+	if strings.HasPrefix(raw, "pac+") {
+		pac, err := newPACResolver(strings.TrimPrefix(raw, "pac+"))
+		if err != nil {
+			return nil, fmt.Errorf("loading PAC file: %w", err)
+		}
+		return &upstreamProxyResolver{pac: pac}, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing upstream proxy %q: %w", raw, err)
+	}
+	static := &resolvedUpstream{addr: u.Host}
+	if u.User != nil {
+		static.user = u.User.Username()
+		static.pass, _ = u.User.Password()
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		static.scheme = upstreamSOCKS5
+	case "http", "https":
+		static.scheme = upstreamHTTP
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q", u.Scheme)
+	}
+	return &upstreamProxyResolver{static: static}, nil
+}
+
+// resolve returns the upstream to use for a request to targetURL (scheme +
+// host set to the real destination, even though for CONNECT tunnels there is
+// no real *url.URL on hand; callers construct a synthetic one).
+func (r *upstreamProxyResolver) resolve(targetURL *url.URL) (*resolvedUpstream, error) {
+	if r.static != nil {
+		return r.static, nil
+	}
+	return r.pac.resolve(targetURL)
+}
+
+// dial connects to addr (host:port), chaining through the configured
+// upstream if any, and forwarding proxyAuth (the client's original
+// Proxy-Authorization header, if present) to an HTTP upstream's CONNECT.
+func (r *upstreamProxyResolver) dial(network, addr, proxyAuth string) (net.Conn, error) {
+	target, err := url.Parse("https://" + addr)
+	if err != nil {
+		return nil, err
+	}
+	up, err := r.resolve(target)
+	if err != nil {
+		return nil, err
+	}
+	switch up.scheme {
+	case upstreamDirect:
+		return net.DialTimeout(network, addr, TIMEOUT_MS*time.Millisecond)
+	case upstreamSOCKS5:
+		var auth *xproxy.Auth
+		if up.user != "" {
+			auth = &xproxy.Auth{User: up.user, Password: up.pass}
+		}
+		dialer, err := xproxy.SOCKS5(network, up.addr, auth, xproxy.Direct)
+		if err != nil {
+			return nil, fmt.Errorf("building SOCKS5 dialer for %v: %w", up.addr, err)
+		}
+		return dialer.Dial(network, addr)
+	case upstreamHTTP:
+		return dialViaHTTPConnect(up, addr, proxyAuth)
+	default:
+		return nil, fmt.Errorf("unknown upstream scheme for %v", addr)
+	}
+}
+
+// dialViaHTTPConnect opens a TCP connection to the upstream HTTP(S) proxy
+// and issues a nested CONNECT for addr, returning the tunnel once
+// established. proxyAuth, if set, is forwarded as-is; otherwise credentials
+// embedded in the upstream proxy URL are used.
+func dialViaHTTPConnect(up *resolvedUpstream, addr, proxyAuth string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", up.addr, TIMEOUT_MS*time.Millisecond)
+	if err != nil {
+		return nil, fmt.Errorf("dialing upstream proxy %v: %w", up.addr, err)
+	}
+
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyAuth != "" {
+		connectReq.Header.Set("Proxy-Authorization", proxyAuth)
+	} else if up.user != "" {
+		connectReq.SetBasicAuth(up.user, up.pass)
+		connectReq.Header.Set("Proxy-Authorization", connectReq.Header.Get("Authorization"))
+		connectReq.Header.Del("Authorization")
+	}
+
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("writing nested CONNECT to %v: %w", up.addr, err)
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading nested CONNECT response from %v: %w", up.addr, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy %v refused CONNECT %v: %v", up.addr, addr, res.Status)
+	}
+	if br.Buffered() > 0 {
+		// Nothing should follow the CONNECT response before our own bytes;
+		// a well-behaved proxy leaves the reader empty at this point.
+		conn = &bufferedConn{Conn: conn, r: br}
+	}
+	return conn, nil
+}
+
+// bufferedConn lets us hand back a net.Conn that first drains any bytes
+// already buffered by bufio.Reader before reading from the raw connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// dialTLS dials addr (chaining through the configured
+// upstream, if any) and then performs the TLS handshake to it directly,
+// mirroring tls.Dial but over a possibly-proxied connection.
+func (r *upstreamProxyResolver) dialTLS(addr string, tlsConfig *tls.Config, proxyAuth string) (*tls.Conn, error) {
+	raw, err := r.dial("tcp", addr, proxyAuth)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(raw, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// pacResolver fetches a PAC script once and evaluates FindProxyForURL
+// against it per destination via a small embedded JS interpreter, caching
+// results by host in a bounded LRU.
+type pacResolver struct {
+	script string
+
+	mu    sync.Mutex
+	vm    *otto.Otto
+	cache *lruCache
+}
+
+func newPACResolver(pacURL string) (*pacResolver, error) {
+	res, err := http.Get(pacURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetching PAC file %v: %w", pacURL, err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading PAC file %v: %w", pacURL, err)
+	}
+
+	vm := otto.New()
+	registerPACHelpers(vm)
+	if _, err := vm.Run(string(body)); err != nil {
+		return nil, fmt.Errorf("evaluating PAC script: %w", err)
+	}
+
+	return &pacResolver{script: string(body), vm: vm, cache: newLRUCache(256)}, nil
+}
+
+func (p *pacResolver) resolve(targetURL *url.URL) (*resolvedUpstream, error) {
+	host := targetURL.Hostname()
+	if cached, ok := p.cache.get(host); ok {
+		return cached.(*resolvedUpstream), nil
+	}
+
+	p.mu.Lock()
+	value, err := p.vm.Call("FindProxyForURL", nil, targetURL.String(), host)
+	p.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("FindProxyForURL(%v): %w", targetURL, err)
+	}
+
+	up, err := parsePACResult(value.String())
+	if err != nil {
+		return nil, err
+	}
+	p.cache.put(host, up)
+	return up, nil
+}
+
+// parsePACResult parses a PAC return value like "PROXY host:port; SOCKS
+// host:port; DIRECT", taking the first entry this proxy knows how to honor.
+func parsePACResult(result string) (*resolvedUpstream, error) {
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(strings.TrimSpace(entry))
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			return &resolvedUpstream{scheme: upstreamDirect}, nil
+		case "PROXY":
+			if len(fields) < 2 {
+				continue
+			}
+			return &resolvedUpstream{scheme: upstreamHTTP, addr: fields[1]}, nil
+		case "SOCKS", "SOCKS5":
+			if len(fields) < 2 {
+				continue
+			}
+			return &resolvedUpstream{scheme: upstreamSOCKS5, addr: fields[1]}, nil
+		}
+	}
+	return nil, fmt.Errorf("unrecognized PAC result %q", result)
+}
+
+// registerPACHelpers wires up the handful of standard PAC utility functions
+// (https://developer.mozilla.org/docs/Web/HTTP/Proxy_servers_and_tunneling/Proxy_Auto-Configuration_PAC_file)
+// most PAC scripts in practice rely on. Functions doing DNS lookups of the
+// client's own address are stubbed since this proxy has no notion of "the
+// machine running the browser".
+func registerPACHelpers(vm *otto.Otto) {
+	vm.Set("isPlainHostName", func(call otto.FunctionCall) otto.Value {
+		host := call.Argument(0).String()
+		v, _ := vm.ToValue(!strings.Contains(host, "."))
+		return v
+	})
+	vm.Set("dnsDomainIs", func(call otto.FunctionCall) otto.Value {
+		host := call.Argument(0).String()
+		domain := call.Argument(1).String()
+		v, _ := vm.ToValue(strings.HasSuffix(host, domain))
+		return v
+	})
+	vm.Set("shExpMatch", func(call otto.FunctionCall) otto.Value {
+		str := call.Argument(0).String()
+		shexp := call.Argument(1).String()
+		ok, _ := path.Match(shexp, str)
+		v, _ := vm.ToValue(ok)
+		return v
+	})
+	vm.Set("myIpAddress", func(call otto.FunctionCall) otto.Value {
+		v, _ := vm.ToValue("127.0.0.1")
+		return v
+	})
+	vm.Set("dnsResolve", func(call otto.FunctionCall) otto.Value {
+		host := call.Argument(0).String()
+		addrs, err := net.LookupHost(host)
+		if err != nil || len(addrs) == 0 {
+			v, _ := vm.ToValue(false)
+			return v
+		}
+		v, _ := vm.ToValue(addrs[0])
+		return v
+	})
+}
+
+// lruCache is a small fixed-capacity least-recently-used cache used to
+// avoid re-evaluating the PAC script for every request to the same host.
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{capacity: capacity, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruEntry).value, true
+}
+
+func (c *lruCache) put(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value.(*lruEntry).value = value
+		c.ll.MoveToFront(el)
+		return
+	}
+	el := c.ll.PushFront(&lruEntry{key: key, value: value})
+	c.items[key] = el
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*lruEntry).key)
+		}
+	}
+}
+
+// proxyFuncFor adapts resolver into the func(*http.Request) (*url.URL,
+// error) shape http.Transport.Proxy expects, for the (non-SOCKS5) plain HTTP
+// request path where net/http itself drives CONNECT when needed.
+func proxyFuncFor(resolver *upstreamProxyResolver) func(*http.Request) (*url.URL, error) {
+	return func(r *http.Request) (*url.URL, error) {
+		up, err := resolver.resolve(r.URL)
+		if err != nil {
+			log.Printf("upstream proxy resolution failed for %v, dialing direct: %v", r.URL, err)
+			return nil, nil
+		}
+		switch up.scheme {
+		case upstreamDirect:
+			return nil, nil
+		case upstreamHTTP:
+			u := &url.URL{Scheme: "http", Host: up.addr}
+			if up.user != "" {
+				u.User = url.UserPassword(up.user, up.pass)
+			}
+			return u, nil
+		default:
+			// http.Transport's Proxy hook can't express a SOCKS5 upstream;
+			// callers that need SOCKS5 chaining configure DialContext instead.
+			return nil, nil
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func TestParsePACResult(t *testing.T) {
+	cases := []struct {
+		result string
+		want   resolvedUpstream
+	}{
+		{"DIRECT", resolvedUpstream{scheme: upstreamDirect}},
+		{"PROXY proxy.example.com:8080", resolvedUpstream{scheme: upstreamHTTP, addr: "proxy.example.com:8080"}},
+		{"SOCKS5 socks.example.com:1080", resolvedUpstream{scheme: upstreamSOCKS5, addr: "socks.example.com:1080"}},
+		{"PROXY bad.example.com:8080; DIRECT", resolvedUpstream{scheme: upstreamHTTP, addr: "bad.example.com:8080"}},
+		{"  ; PROXY p.example.com:80", resolvedUpstream{scheme: upstreamHTTP, addr: "p.example.com:80"}},
+	}
+	for _, c := range cases {
+		got, err := parsePACResult(c.result)
+		if err != nil {
+			t.Errorf("parsePACResult(%q) returned error: %v", c.result, err)
+			continue
+		}
+		if got.scheme != c.want.scheme || got.addr != c.want.addr {
+			t.Errorf("parsePACResult(%q) = %+v, want %+v", c.result, *got, c.want)
+		}
+	}
+}
+
+func TestParsePACResultUnrecognized(t *testing.T) {
+	if _, err := parsePACResult("nonsense"); err == nil {
+		t.Fatalf("parsePACResult(%q) returned no error, want one", "nonsense")
+	}
+}
+
+func TestLRUCacheGetPut(t *testing.T) {
+	c := newLRUCache(2)
+	if _, ok := c.get("a"); ok {
+		t.Fatalf("get on empty cache returned ok=true")
+	}
+
+	c.put("a", 1)
+	c.put("b", 2)
+	if v, ok := c.get("a"); !ok || v != 1 {
+		t.Fatalf("get(a) = %v, %v, want 1, true", v, ok)
+	}
+}
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLRUCache(2)
+	c.put("a", 1)
+	c.put("b", 2)
+	c.get("a") // touch a so it's no longer the least-recently-used
+	c.put("c", 3)
+
+	if _, ok := c.get("b"); ok {
+		t.Fatalf("b should have been evicted, but is still present")
+	}
+	if v, ok := c.get("a"); !ok || v != 1 {
+		t.Fatalf("a should still be cached, got %v, %v", v, ok)
+	}
+	if v, ok := c.get("c"); !ok || v != 3 {
+		t.Fatalf("c should be cached, got %v, %v", v, ok)
+	}
+}
+
+func TestLRUCachePutUpdatesExistingKey(t *testing.T) {
+	c := newLRUCache(2)
+	c.put("a", 1)
+	c.put("a", 2)
+	if v, ok := c.get("a"); !ok || v != 2 {
+		t.Fatalf("get(a) = %v, %v, want 2, true", v, ok)
+	}
+	if c.ll.Len() != 1 {
+		t.Fatalf("re-putting an existing key grew the list to %d entries", c.ll.Len())
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// userAgent is one entry in a weighted User-Agent rotation table: ua is the
+// literal header value to send, and pct is its relative weight (weights
+// need not sum to 1; uaRotator normalizes them). The sentinel ua value
+// passthroughUA keeps the client's original User-Agent instead of
+// substituting one.
+type userAgent struct {
+	ua  string
+	pct float32
+}
+
+// passthroughUA is the userAgent.ua value that means "leave the client's
+// own User-Agent header alone" rather than substituting a configured one.
+const passthroughUA = "passthrough"
+
+// uaStatsPath is the loopback-only debug endpoint that reports how many
+// times each configured userAgent (including passthroughUA) has been used.
+const uaStatsPath = "/._proxy/ua-stats"
+
+// uaConfigEntry is the on-disk JSON shape of a userAgent entry; userAgent
+// itself keeps unexported fields like every other config-adjacent struct in
+// this package, so loading goes through this exported mirror.
+type uaConfigEntry struct {
+	UA  string  `json:"ua"`
+	Pct float32 `json:"pct"`
+}
+
+// loadUserAgents reads a JSON array of {"ua": ..., "pct": ...} entries from
+// path, as referenced by config.userAgentsPath.
+func loadUserAgents(path string) ([]userAgent, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading user agent list %v: %w", path, err)
+	}
+	var entries []uaConfigEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parsing user agent list %v: %w", path, err)
+	}
+	uas := make([]userAgent, len(entries))
+	for i, e := range entries {
+		uas[i] = userAgent{ua: e.UA, pct: e.Pct}
+	}
+	return uas, nil
+}
+
+// uaRotator samples from a weighted table of userAgent entries and counts
+// how many times each one (including passthroughUA) has been served, for
+// the uaStatsPath debug endpoint.
+type uaRotator struct {
+	cumulative []userAgent // pct rewritten to a running total, ascending to 1
+
+	mu     sync.Mutex
+	rng    *rand.Rand
+	counts map[string]int
+}
+
+// newUARotator builds a rotator from entries, normalizing their weights so
+// they sum to 1 regardless of the scale they were configured in.
+func newUARotator(entries []userAgent) (*uaRotator, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no user agent entries configured")
+	}
+	var total float32
+	for _, e := range entries {
+		total += e.pct
+	}
+	if total <= 0 {
+		return nil, fmt.Errorf("user agent weights sum to %v, want > 0", total)
+	}
+
+	cumulative := make([]userAgent, len(entries))
+	var running float32
+	for i, e := range entries {
+		running += e.pct / total
+		cumulative[i] = userAgent{ua: e.ua, pct: running}
+	}
+
+	return &uaRotator{
+		cumulative: cumulative,
+		rng:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		counts:     make(map[string]int),
+	}, nil
+}
+
+// pick samples a single userAgent.ua from the weighted distribution and
+// records the pick for uaStatsPath.
+func (u *uaRotator) pick() string {
+	u.mu.Lock()
+	roll := u.rng.Float32()
+	var chosen string
+	for _, e := range u.cumulative {
+		if roll <= e.pct {
+			chosen = e.ua
+			break
+		}
+	}
+	if chosen == "" {
+		chosen = u.cumulative[len(u.cumulative)-1].ua
+	}
+	u.counts[chosen]++
+	u.mu.Unlock()
+	return chosen
+}
+
+// statsSnapshot returns a point-in-time copy of the per-UA counters.
+func (u *uaRotator) statsSnapshot() map[string]int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	snapshot := make(map[string]int, len(u.counts))
+	for k, v := range u.counts {
+		snapshot[k] = v
+	}
+	return snapshot
+}
+
+// RotateUserAgent rewrites the outbound User-Agent header by sampling from
+// rotator, leaving the client's original header in place when passthroughUA
+// is drawn. Registering it on the shared *Proxy handler chain covers both
+// the plain HTTP path and the MITM tunnel path, which both route requests
+// through the same chain.
+func RotateUserAgent(rotator *uaRotator) ReqHandler {
+	return func(r *http.Request) (*http.Request, *http.Response) {
+		if chosen := rotator.pick(); chosen != passthroughUA {
+			r.Header.Set("User-Agent", chosen)
+		}
+		return r, nil
+	}
+}
+
+// serveUAStats serves rotator's per-UA counters as JSON. It refuses any
+// request that didn't originate from loopback, since this is an operator
+// debug endpoint rather than something to expose to traffic passing through
+// the proxy.
+func serveUAStats(rotator *uaRotator, w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rotator.statsSnapshot()); err != nil {
+		log.Printf("ua-stats: encoding response: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewUARotatorRejectsEmptyOrZeroWeight(t *testing.T) {
+	if _, err := newUARotator(nil); err == nil {
+		t.Fatalf("newUARotator(nil) returned no error")
+	}
+	if _, err := newUARotator([]userAgent{{ua: "a", pct: 0}}); err == nil {
+		t.Fatalf("newUARotator with zero total weight returned no error")
+	}
+}
+
+func TestUARotatorPickDistribution(t *testing.T) {
+	rotator, err := newUARotator([]userAgent{
+		{ua: "common", pct: 3},
+		{ua: "rare", pct: 1},
+	})
+	if err != nil {
+		t.Fatalf("newUARotator: %v", err)
+	}
+
+	const n = 20000
+	for i := 0; i < n; i++ {
+		rotator.pick()
+	}
+
+	snapshot := rotator.statsSnapshot()
+	if snapshot["common"]+snapshot["rare"] != n {
+		t.Fatalf("counts sum to %v, want %v", snapshot["common"]+snapshot["rare"], n)
+	}
+
+	gotRatio := float64(snapshot["common"]) / float64(n)
+	wantRatio := 0.75 // 3 / (3+1), normalized
+	if math.Abs(gotRatio-wantRatio) > 0.03 {
+		t.Fatalf("common UA fraction = %v, want ~%v", gotRatio, wantRatio)
+	}
+}
+
+func TestRotateUserAgentPassthroughLeavesHeaderAlone(t *testing.T) {
+	rotator, err := newUARotator([]userAgent{{ua: passthroughUA, pct: 1}})
+	if err != nil {
+		t.Fatalf("newUARotator: %v", err)
+	}
+	handler := RotateUserAgent(rotator)
+
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.Header.Set("User-Agent", "original-client-ua")
+
+	r, res := handler(r)
+	if res != nil {
+		t.Fatalf("RotateUserAgent short-circuited with a response")
+	}
+	if got := r.Header.Get("User-Agent"); got != "original-client-ua" {
+		t.Fatalf("User-Agent header = %q, want original left in place", got)
+	}
+}
+
+func TestRotateUserAgentSubstitutesConfiguredUA(t *testing.T) {
+	rotator, err := newUARotator([]userAgent{{ua: "configured-ua", pct: 1}})
+	if err != nil {
+		t.Fatalf("newUARotator: %v", err)
+	}
+	handler := RotateUserAgent(rotator)
+
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.Header.Set("User-Agent", "original-client-ua")
+
+	r, _ = handler(r)
+	if got := r.Header.Get("User-Agent"); got != "configured-ua" {
+		t.Fatalf("User-Agent header = %q, want %q", got, "configured-ua")
+	}
+}